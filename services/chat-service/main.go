@@ -2,140 +2,1000 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
 )
 
+// defaultRoom is used when a client or message does not name a room.
+const defaultRoom = "global"
+
+const (
+	// Time allowed to write a message to the peer.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	pongWait = 60 * time.Second
+
+	// Send pings to the peer with this period. Must be less than pongWait.
+	pingPeriod = 54 * time.Second
+
+	// Bytes allowed in a frame on top of the text, for the other JSON fields.
+	frameOverhead = 4 * 1024
+
+	// Time Hub.Close waits for clients to receive their close frame.
+	drainTimeout = 5 * time.Second
+
+	// Time allowed for in-flight HTTP requests to finish on shutdown.
+	shutdownTimeout = 10 * time.Second
+
+	// How often idle rate limiter buckets are evicted.
+	limiterSweepPeriod = time.Minute
+
+	// Lifetime of an instance's presence entries in Redis. Entries from an
+	// instance that dies without shutting down expire after this long.
+	presenceTTL = 30 * time.Second
+
+	// How often an instance refreshes its presence entries. Must be less
+	// than presenceTTL.
+	presenceRefresh = 10 * time.Second
+)
+
+const (
+	// Number of messages kept in Redis per room.
+	historySize = 200
+
+	// Number of messages returned by /history when no limit is given.
+	defaultHistoryLimit = 50
+
+	// Largest limit accepted by /history.
+	maxHistoryLimit = historySize
+)
+
 type Message struct {
 	UserID    string `json:"user_id"`
+	Room      string `json:"room"`
+	To        string `json:"to,omitempty"`
+	Type      string `json:"type,omitempty"`
 	Text      string `json:"text"`
 	Timestamp int64  `json:"timestamp"`
 }
 
+// Message types for messages generated by the server rather than a user.
+const (
+	typeSystem = "system"
+	typeJoin   = "join"
+	typeLeave  = "leave"
+)
+
+// presenceChange records a user's first connection to, or last disconnection
+// from, a room on this instance.
+type presenceChange struct {
+	room   string
+	user   string
+	joined bool
+}
+
+// maxTextLength is the maximum number of characters in Message.Text. main may
+// override it from CHAT_MAX_MESSAGE_LENGTH.
+var maxTextLength = 2000
+
+// maxFrameSize is the largest frame in bytes accepted from the peer. Larger
+// frames close the connection, so it must fit any text validate accepts: a
+// character JSON-escaped as a surrogate pair ("\ud83d\ude00") takes 12 bytes.
+func maxFrameSize() int64 {
+	return int64(maxTextLength)*12 + frameOverhead
+}
+
+var (
+	errEmptyText   = errors.New("text is empty")
+	errTextTooLong = errors.New("text is too long")
+	errInvalidUTF8 = errors.New("text is not valid UTF-8")
+)
+
+// validate reports whether m is fit to broadcast.
+func (m Message) validate() error {
+	if strings.TrimSpace(m.Text) == "" {
+		return errEmptyText
+	}
+	if !utf8.ValidString(m.Text) {
+		return errInvalidUTF8
+	}
+	if utf8.RuneCountInString(m.Text) > maxTextLength {
+		return errTextTooLong
+	}
+	return nil
+}
+
+// reply is a message addressed to a single connection rather than a room.
+type reply struct {
+	client *Client
+	msg    Message
+}
+
+// envelope is the payload published to Redis. Origin identifies the
+// publishing Hub so it can ignore its own messages when they come back.
+type envelope struct {
+	Origin  string  `json:"origin"`
+	Message Message `json:"message"`
+}
+
 type Hub struct {
-	clients    map[*Client]bool
+	id         string
+	rooms      map[string]map[*Client]bool
+	presence   map[string]map[string]int
+	changes    []presenceChange
 	broadcast  chan Message
+	remote     chan Message
+	reply      chan reply
 	register   chan *Client
 	unregister chan *Client
 	mutex      sync.RWMutex
+	limiter    *rateLimiter
 	redis      *redis.Client
 	ctx        context.Context
+	cancel     context.CancelFunc
+
+	// done is closed by Close. closed is guarded by mutex and keeps run and
+	// serve from adding to the WaitGroups below once Close has started.
+	done   chan struct{}
+	closed bool
+
+	// pumps counts running writePumps so Close can wait for them to drain.
+	pumps sync.WaitGroup
+
+	// runner tracks the run loop so Close can let it finish its current
+	// event before cleaning up.
+	runner sync.WaitGroup
+
+	// subscriber tracks the Redis subscriber so Close doesn't close the Redis
+	// client underneath it.
+	subscriber sync.WaitGroup
 }
 
 type Client struct {
-	hub   *Hub
-	conn  *websocket.Conn
-	send  chan Message
-	user  string
+	hub  *Hub
+	conn *websocket.Conn
+	send chan Message
+	user string
+	room string
+
+	// throttled is set while the client's messages are being dropped by the
+	// rate limiter, so it is only warned once per burst. Only readPump uses it.
+	throttled bool
 }
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
+// jwtSecret is the HMAC key used to verify client tokens. main loads it from
+// the JWT_SECRET environment variable.
+var jwtSecret []byte
+
+var (
+	errMissingToken   = errors.New("missing token")
+	errMissingSubject = errors.New("token has no sub claim")
+	errDrainTimeout   = errors.New("timed out waiting for clients to drain")
+)
+
+// authenticate validates the JWT carried by r and returns the user id from
+// its sub claim. The token is read from the Authorization header, falling
+// back to the token query param for browser clients that can't set headers.
+func authenticate(r *http.Request) (string, error) {
+	tokenString := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); header != "" {
+		tokenString = strings.TrimPrefix(header, "Bearer ")
+	}
+	if tokenString == "" {
+		return "", errMissingToken
+	}
+
+	token, err := jwt.Parse(tokenString, func(*jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}), jwt.WithExpirationRequired())
+	if err != nil {
+		return "", err
+	}
+
+	user, err := token.Claims.GetSubject()
+	if err != nil {
+		return "", err
+	}
+	if user == "" {
+		return "", errMissingSubject
+	}
+	return user, nil
+}
+
+// Per-user message rate limit. main may override these from CHAT_RATE_LIMIT
+// (messages per second) and CHAT_RATE_BURST.
+var (
+	rateLimit = 5.0
+	rateBurst = 10
+)
+
+// rateLimiter is a token bucket limiter keyed by user id.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow reports whether user may send another message now, consuming a
+// token if so.
+func (l *rateLimiter) allow(user string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[user]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[user] = b
+	}
+
+	l.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill adds the tokens earned since b was last used, up to burst.
+func (l *rateLimiter) refill(b *bucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+}
+
+// sweep evicts buckets that have refilled to burst. Those are equivalent to a
+// fresh bucket, so dropping them frees memory for idle users without letting
+// anyone reset their limit by reconnecting.
+func (l *rateLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for user, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, user)
+		}
+	}
+}
+
 func NewHub(redisClient *redis.Client) *Hub {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Hub{
-		clients:    make(map[*Client]bool),
+		id:         newInstanceID(),
+		rooms:      make(map[string]map[*Client]bool),
+		presence:   make(map[string]map[string]int),
 		broadcast:  make(chan Message),
+		remote:     make(chan Message),
+		reply:      make(chan reply),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		limiter:    newRateLimiter(rateLimit, rateBurst),
 		redis:      redisClient,
-		ctx:        context.Background(),
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
 	}
 }
 
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate instance id: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// roomOrDefault returns room, or defaultRoom if it is empty.
+func roomOrDefault(room string) string {
+	if room == "" {
+		return defaultRoom
+	}
+	return room
+}
+
+// roomChannel returns the Redis pub/sub channel for room.
+func roomChannel(room string) string {
+	return "chat:" + room
+}
+
+// historyKey returns the Redis list holding recent messages for room.
+func historyKey(room string) string {
+	return "chat:history:" + room
+}
+
+// presenceKey returns the Redis set indexing the instances with users in
+// room.
+func presenceKey(room string) string {
+	return "chat:presence:" + room
+}
+
+// instancePresenceKey returns the Redis hash mapping each user in room to
+// their number of connections on instance id. It expires unless the
+// instance keeps refreshing it.
+func instancePresenceKey(room, id string) string {
+	return presenceKey(room) + ":" + id
+}
+
+// updatePresenceScript sets this instance's connection count for a user,
+// refreshes the TTLs and returns how many other live instances also have
+// the user in the room. Instances whose hash has expired are pruned from the
+// index. Running it as a script keeps the update and the check atomic with
+// respect to other instances.
+//
+// KEYS: presenceKey, instancePresenceKey. ARGV: instance id, user, count,
+// TTL in seconds.
+var updatePresenceScript = redis.NewScript(`
+local index, own = KEYS[1], KEYS[2]
+local id, user, count, ttl = ARGV[1], ARGV[2], tonumber(ARGV[3]), ARGV[4]
+
+if count > 0 then
+	redis.call("HSET", own, user, count)
+	redis.call("EXPIRE", own, ttl)
+	redis.call("SADD", index, id)
+	redis.call("EXPIRE", index, ttl)
+else
+	redis.call("HDEL", own, user)
+	if redis.call("EXISTS", own) == 0 then
+		redis.call("SREM", index, id)
+	end
+end
+
+local others = 0
+for _, other in ipairs(redis.call("SMEMBERS", index)) do
+	if other ~= id then
+		local key = index .. ":" .. other
+		if redis.call("EXISTS", key) == 0 then
+			redis.call("SREM", index, other)
+		elseif redis.call("HEXISTS", key, user) == 1 then
+			others = others + 1
+		end
+	end
+end
+return others
+`)
+
+// onlineScript returns the users in room on every live instance, pruning
+// expired instances from the index. KEYS: presenceKey.
+var onlineScript = redis.NewScript(`
+local index = KEYS[1]
+local seen, users = {}, {}
+for _, id in ipairs(redis.call("SMEMBERS", index)) do
+	local key = index .. ":" .. id
+	if redis.call("EXISTS", key) == 0 then
+		redis.call("SREM", index, id)
+	else
+		for _, user in ipairs(redis.call("HKEYS", key)) do
+			if not seen[user] then
+				seen[user] = true
+				table.insert(users, user)
+			end
+		end
+	end
+end
+return users
+`)
+
 func (h *Hub) run() {
+	// As in serve, checking closed under the lock keeps these Adds from
+	// overlapping Close's Waits.
+	h.mutex.Lock()
+	if h.closed {
+		h.mutex.Unlock()
+		return
+	}
+	h.runner.Add(1)
+	h.subscriber.Add(1)
+	h.mutex.Unlock()
+	defer h.runner.Done()
+
+	go func() {
+		defer h.subscriber.Done()
+		h.subscribe()
+	}()
+
+	sweep := time.NewTicker(limiterSweepPeriod)
+	defer sweep.Stop()
+	heartbeat := time.NewTicker(presenceRefresh)
+	defer heartbeat.Stop()
+
 	for {
 		select {
 		case client := <-h.register:
+			room := roomOrDefault(client.room)
 			h.mutex.Lock()
-			h.clients[client] = true
-			log.Printf("Client registered. Total: %d", len(h.clients))
+			if h.rooms[room] == nil {
+				h.rooms[room] = make(map[*Client]bool)
+			}
+			h.rooms[room][client] = true
+			if h.presence[room] == nil {
+				h.presence[room] = make(map[string]int)
+			}
+			h.presence[room][client.user]++
+			if h.presence[room][client.user] == 1 {
+				h.changes = append(h.changes, presenceChange{room: room, user: client.user, joined: true})
+			}
+			log.Printf("Client registered in room %q. Total: %d", room, len(h.rooms[room]))
 			h.mutex.Unlock()
 		case client := <-h.unregister:
+			room := roomOrDefault(client.room)
 			h.mutex.Lock()
-			delete(h.clients, client)
-			close(client.send)
-			log.Printf("Client unregistered. Total: %d", len(h.clients))
+			h.removeClient(room, client)
+			log.Printf("Client unregistered from room %q. Total: %d", room, len(h.rooms[room]))
 			h.mutex.Unlock()
 		case msg := <-h.broadcast:
-			// Publish to Redis for other instances
-			data, _ := json.Marshal(msg)
-			h.redis.Publish(h.ctx, "chat", string(data))
+			h.dispatch(msg)
+		case msg := <-h.remote:
+			h.deliverLocal(msg)
+		case r := <-h.reply:
+			room := roomOrDefault(r.client.room)
+			h.mutex.Lock()
+			if h.rooms[room][r.client] {
+				h.trySend(room, r.client, r.msg)
+			}
+			h.mutex.Unlock()
+		case <-sweep.C:
+			h.limiter.sweep()
+		case <-heartbeat.C:
+			h.refreshPresence()
+		case <-h.done:
+			return
+		}
 
-			// Broadcast locally
-			h.mutex.RLock()
-			for client := range h.clients {
-				select {
-				case client.send <- msg:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+		h.flushPresence()
+	}
+}
+
+// dispatch persists msg, publishes it to other instances and delivers it
+// locally.
+func (h *Hub) dispatch(msg Message) {
+	msg.Room = roomOrDefault(msg.Room)
+	// Direct and system messages stay out of the room's public history
+	if msg.To == "" && msg.Type == "" {
+		h.persist(msg)
+	}
+
+	// Publish to Redis for other instances
+	data, _ := json.Marshal(envelope{Origin: h.id, Message: msg})
+	if err := h.redis.Publish(h.ctx, roomChannel(msg.Room), string(data)).Err(); err != nil {
+		log.Printf("Redis publish error: %v", err)
+	}
+	h.deliverLocal(msg)
+}
+
+// flushPresence applies pending presence changes to Redis and announces
+// joins and leaves to the room. Events only fire when no other live instance
+// has the user in the room; if Redis is unavailable this instance's counts
+// are used instead. It must be called without h.mutex held.
+func (h *Hub) flushPresence() {
+	h.mutex.Lock()
+	changes := h.changes
+	h.changes = nil
+	counts := make([]int, len(changes))
+	for i, change := range changes {
+		counts[i] = h.presence[change.room][change.user]
+	}
+	h.mutex.Unlock()
+
+	ttl := int(presenceTTL / time.Second)
+	for i, change := range changes {
+		keys := []string{presenceKey(change.room), instancePresenceKey(change.room, h.id)}
+		others, err := updatePresenceScript.Run(h.ctx, h.redis, keys, h.id, change.user, counts[i], ttl).Int64()
+		if err != nil {
+			log.Printf("Redis presence error: %v", err)
+		} else if others > 0 {
+			continue
+		}
+
+		msg := Message{UserID: change.user, Room: change.room, Type: typeLeave, Timestamp: time.Now().Unix()}
+		if change.joined {
+			msg.Type = typeJoin
+		}
+		h.dispatch(msg)
+	}
+}
+
+// refreshPresence rewrites this instance's presence entries and extends
+// their TTL, so they only outlive the instance by presenceTTL.
+func (h *Hub) refreshPresence() {
+	h.mutex.RLock()
+	rooms := make(map[string]map[string]interface{}, len(h.presence))
+	for room, users := range h.presence {
+		counts := make(map[string]interface{}, len(users))
+		for user, n := range users {
+			counts[user] = n
+		}
+		rooms[room] = counts
+	}
+	h.mutex.RUnlock()
+
+	for room, counts := range rooms {
+		key := instancePresenceKey(room, h.id)
+		_, err := h.redis.TxPipelined(h.ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(h.ctx, key)
+			pipe.HSet(h.ctx, key, counts)
+			pipe.Expire(h.ctx, key, presenceTTL)
+			pipe.SAdd(h.ctx, presenceKey(room), h.id)
+			pipe.Expire(h.ctx, presenceKey(room), presenceTTL)
+			return nil
+		})
+		if err != nil {
+			log.Printf("Redis presence refresh error: %v", err)
+		}
+	}
+}
+
+// online returns the users connected to room, sorted. It reads the presence
+// entries of every live instance, falling back to this instance's clients if
+// Redis is unavailable.
+func (h *Hub) online(room string) []string {
+	users, err := onlineScript.Run(h.ctx, h.redis, []string{presenceKey(room)}).StringSlice()
+	if err != nil {
+		log.Printf("Redis presence read error: %v", err)
+		h.mutex.RLock()
+		users = make([]string, 0, len(h.presence[room]))
+		for user := range h.presence[room] {
+			users = append(users, user)
+		}
+		h.mutex.RUnlock()
+	}
+	sort.Strings(users)
+	return users
+}
+
+// serve registers a client for conn and starts its pumps.
+func (h *Hub) serve(conn *websocket.Conn, user, room string) {
+	client := &Client{
+		hub:  h,
+		conn: conn,
+		send: make(chan Message, 256),
+		user: user,
+		room: room,
+	}
+
+	// Checking closed under the same lock Close sets it with guarantees
+	// this Add happens before Close starts waiting on pumps.
+	h.mutex.Lock()
+	if h.closed {
+		h.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	h.pumps.Add(1)
+	h.mutex.Unlock()
+
+	select {
+	case h.register <- client:
+	case <-h.done:
+		h.pumps.Done()
+		conn.Close()
+		return
+	}
+
+	go client.readPump()
+	go func() {
+		defer h.pumps.Done()
+		client.writePump()
+	}()
+}
+
+// Close shuts the hub down. It stops the run loop and waits for it to
+// return, closes every client's send channel so its writePump flushes
+// pending messages and sends a close frame, announces the resulting leaves,
+// waits up to drainTimeout for the writePumps to exit and finally closes the
+// Redis client. Callers should stop accepting new connections first.
+func (h *Hub) Close() error {
+	h.mutex.Lock()
+	if h.closed {
+		h.mutex.Unlock()
+		return nil
+	}
+	h.closed = true
+	close(h.done)
+	h.mutex.Unlock()
+
+	// Once run has returned nothing else touches the clients or flushes
+	// presence changes
+	h.runner.Wait()
+
+	h.mutex.Lock()
+	for room, clients := range h.rooms {
+		for client := range clients {
+			h.removeClient(room, client)
+		}
+	}
+	h.mutex.Unlock()
+
+	// Clear this instance's connections from Redis presence before the
+	// Redis client goes away
+	h.flushPresence()
+	h.cancel()
+
+	drained := make(chan struct{})
+	go func() {
+		h.pumps.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		err = errDrainTimeout
+	}
+
+	h.subscriber.Wait()
+	if closeErr := h.redis.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// removeClient drops client from room and closes its send channel. It is a
+// no-op for clients that were already removed, so send is closed exactly
+// once. Empty rooms are deleted so they don't accumulate. A leave is queued
+// for flushPresence when this was the user's last connection to the room.
+// The caller must hold h.mutex.
+func (h *Hub) removeClient(room string, client *Client) {
+	clients := h.rooms[room]
+	if !clients[client] {
+		return
+	}
+	delete(clients, client)
+	close(client.send)
+	if len(clients) == 0 {
+		delete(h.rooms, room)
+	}
+
+	h.presence[room][client.user]--
+	if h.presence[room][client.user] <= 0 {
+		delete(h.presence[room], client.user)
+		if len(h.presence[room]) == 0 {
+			delete(h.presence, room)
+		}
+		h.changes = append(h.changes, presenceChange{room: room, user: client.user})
+	}
+}
+
+// deliverLocal fans msg out to the clients in msg.Room connected to this
+// instance. Direct messages (msg.To set) instead go to every connection of
+// the recipient and the sender, whatever room they are in.
+func (h *Hub) deliverLocal(msg Message) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if msg.To != "" {
+		for room, clients := range h.rooms {
+			for client := range clients {
+				if client.user == msg.To || client.user == msg.UserID {
+					h.trySend(room, client, msg)
 				}
 			}
-			h.mutex.RUnlock()
+		}
+		return
+	}
+
+	room := roomOrDefault(msg.Room)
+	for client := range h.rooms[room] {
+		h.trySend(room, client, msg)
+	}
+}
+
+// trySend queues msg for client, dropping the client if its buffer is full.
+// The caller must hold h.mutex.
+func (h *Hub) trySend(room string, client *Client, msg Message) {
+	select {
+	case client.send <- msg:
+	default:
+		h.removeClient(room, client)
+	}
+}
+
+// persist appends msg to its room's history, trimmed to historySize. It is
+// best-effort: failures are logged and the message is still broadcast.
+func (h *Hub) persist(msg Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("History marshal error: %v", err)
+		return
+	}
+	key := historyKey(msg.Room)
+	_, err = h.redis.TxPipelined(h.ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(h.ctx, key, data)
+		pipe.LTrim(h.ctx, key, 0, historySize-1)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Redis history write error: %v", err)
+	}
+}
+
+// history returns up to limit of the most recent messages in room, oldest
+// first.
+func (h *Hub) history(room string, limit int) ([]Message, error) {
+	entries, err := h.redis.LRange(h.ctx, historyKey(room), 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		var msg Message
+		if err := json.Unmarshal([]byte(entries[i]), &msg); err != nil {
+			log.Printf("Invalid history entry in room %q: %v", room, err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// subscribe relays messages published by other instances to the run loop.
+// Messages published by this Hub are skipped since they were already
+// delivered locally.
+func (h *Hub) subscribe() {
+	pubsub := h.redis.PSubscribe(h.ctx, roomChannel("*"))
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		var m *redis.Message
+		var ok bool
+		select {
+		case m, ok = <-ch:
+			if !ok {
+				return
+			}
+		case <-h.done:
+			return
+		}
+
+		var env envelope
+		if err := json.Unmarshal([]byte(m.Payload), &env); err != nil {
+			log.Printf("Invalid Redis message: %v", err)
+			continue
+		}
+		if env.Origin == h.id {
+			continue
+		}
+
+		select {
+		case h.remote <- env.Message:
+		case <-h.done:
+			return
 		}
 	}
 }
 
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
 		c.conn.Close()
 	}()
 
+	c.conn.SetReadLimit(maxFrameSize())
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
 	for {
-		var msg Message
-		if err := c.conn.ReadJSON(&msg); err != nil {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
 			break
 		}
+		if !c.hub.limiter.allow(c.user) {
+			if !c.throttled {
+				c.throttled = true
+				notice := reply{client: c, msg: Message{
+					UserID:    "system",
+					Room:      c.room,
+					Type:      typeSystem,
+					Text:      "You are sending messages too fast; some were dropped.",
+					Timestamp: time.Now().Unix(),
+				}}
+				select {
+				case c.hub.reply <- notice:
+				case <-c.hub.done:
+					return
+				}
+			}
+			continue
+		}
+		c.throttled = false
+
+		// Bad messages are skipped rather than closing the connection.
+		// json.Unmarshal silently replaces invalid UTF-8, so check the raw
+		// frame first.
+		var msg Message
+		if !utf8.Valid(data) {
+			log.Printf("Dropping message from %s: %v", c.user, errInvalidUTF8)
+			continue
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("Dropping message from %s: %v", c.user, err)
+			continue
+		}
+		if err := msg.validate(); err != nil {
+			log.Printf("Dropping message from %s: %v", c.user, err)
+			continue
+		}
+
 		msg.UserID = c.user
-		c.hub.broadcast <- msg
+		msg.Room = c.room
+		msg.Type = ""
+		if msg.Timestamp == 0 {
+			msg.Timestamp = time.Now().Unix()
+		}
+		select {
+		case c.hub.broadcast <- msg:
+		case <-c.hub.done:
+			return
+		}
 	}
 }
 
+// writePump writes messages from c.send and pings the peer every
+// pingPeriod. Closing the connection on exit makes readPump fail, which in
+// turn unregisters the client.
 func (c *Client) writePump() {
-	defer c.conn.Close()
-	for msg := range c.send {
-		if err := c.conn.WriteJSON(msg); err != nil {
-			return
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel
+				code := websocket.CloseNormalClosure
+				select {
+				case <-c.hub.done:
+					code = websocket.CloseGoingAway
+				default:
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""))
+				return
+			}
+			if err := c.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
 		}
 	}
 }
 
-func main() {
-	// Init Redis
-	rdb := redis.NewClient(&redis.Options{
-		Addr: "redis:6379",
-	})
-	defer rdb.Close()
-
-	if err := rdb.Ping(context.Background()).Err(); err != nil {
-		log.Fatalf("Redis connection failed: %v", err)
+// redactQuery masks the value of any token param in rawQuery so JWTs passed
+// by browser clients don't end up in the access log.
+func redactQuery(rawQuery string) string {
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if k, err := url.QueryUnescape(key); err == nil && k == "token" {
+			params[i] = key + "=REDACTED"
+		}
 	}
-	log.Println("Connected to Redis")
+	return strings.Join(params, "&")
+}
 
-	// Init Hub
-	hub := NewHub(rdb)
-	go hub.run()
+// logFormatter is gin's access log format with the query string redacted.
+func logFormatter(param gin.LogFormatterParams) string {
+	path := param.Path
+	if p, rawQuery, ok := strings.Cut(path, "?"); ok {
+		path = p + "?" + redactQuery(rawQuery)
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		path,
+		param.ErrorMessage,
+	)
+}
 
-	r := gin.Default()
+func newRouter(hub *Hub) *gin.Engine {
+	r := gin.New()
+	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{Formatter: logFormatter}), gin.Recovery())
 
 	r.GET("/", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "Chat Service Running"})
 	})
 
+	r.GET("/history", func(c *gin.Context) {
+		room := roomOrDefault(c.Query("room"))
+		limit := defaultHistoryLimit
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+				return
+			}
+			limit = n
+		}
+		if limit > maxHistoryLimit {
+			limit = maxHistoryLimit
+		}
+
+		messages, err := hub.history(room, limit)
+		if err != nil {
+			log.Printf("Redis history read error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load history"})
+			return
+		}
+		c.JSON(http.StatusOK, messages)
+	})
+
+	r.GET("/presence", func(c *gin.Context) {
+		room := roomOrDefault(c.Query("room"))
+		c.JSON(http.StatusOK, hub.online(room))
+	})
+
 	r.GET("/ws", func(c *gin.Context) {
-		user := c.DefaultQuery("user", "anonymous")
+		user, err := authenticate(c.Request)
+		if err != nil {
+			log.Printf("WebSocket auth error: %v", err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+
+		room := c.DefaultQuery("room", defaultRoom)
 		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
 			log.Printf("WebSocket upgrade error: %v", err)
@@ -143,18 +1003,77 @@ func main() {
 			return
 		}
 
-		client := &Client{
-			hub:  hub,
-			conn: conn,
-			send: make(chan Message, 256),
-			user: user,
+		hub.serve(conn, user, room)
+	})
+
+	return r
+}
+
+func main() {
+	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+	if len(jwtSecret) == 0 {
+		log.Fatal("JWT_SECRET must be set")
+	}
+	if v := os.Getenv("CHAT_RATE_LIMIT"); v != "" {
+		limit, err := strconv.ParseFloat(v, 64)
+		if err != nil || limit <= 0 {
+			log.Fatalf("Invalid CHAT_RATE_LIMIT %q", v)
+		}
+		rateLimit = limit
+	}
+	if v := os.Getenv("CHAT_RATE_BURST"); v != "" {
+		burst, err := strconv.Atoi(v)
+		if err != nil || burst < 1 {
+			log.Fatalf("Invalid CHAT_RATE_BURST %q", v)
 		}
-		hub.register <- client
+		rateBurst = burst
+	}
+	if v := os.Getenv("CHAT_MAX_MESSAGE_LENGTH"); v != "" {
+		length, err := strconv.Atoi(v)
+		if err != nil || length < 1 {
+			log.Fatalf("Invalid CHAT_MAX_MESSAGE_LENGTH %q", v)
+		}
+		maxTextLength = length
+	}
 
-		go client.readPump()
-		go client.writePump()
+	// Init Redis
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "redis:6379",
 	})
 
-	log.Println("Chat Service listening on :3002")
-	r.Run(":3002")
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		log.Fatalf("Redis connection failed: %v", err)
+	}
+	log.Println("Connected to Redis")
+
+	// Init Hub
+	hub := NewHub(rdb)
+	go hub.run()
+
+	srv := &http.Server{
+		Addr:    ":3002",
+		Handler: newRouter(hub),
+	}
+	go func() {
+		log.Println("Chat Service listening on :3002")
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("Shutting down")
+
+	// Stop accepting new connections before telling clients to go away
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("HTTP shutdown error: %v", err)
+	}
+	if err := hub.Close(); err != nil {
+		log.Printf("Hub shutdown error: %v", err)
+	}
+	log.Println("Chat Service stopped")
 }
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
 )
@@ -19,7 +26,86 @@ func setupTestHub(t *testing.T) *Hub {
 	if err := rdb.Ping(context.Background()).Err(); err != nil {
 		t.Skipf("Redis not available: %v", err)
 	}
-	return NewHub(rdb)
+	hub := NewHub(rdb)
+	t.Cleanup(func() { hub.Close() })
+	return hub
+}
+
+// isPresence reports whether msg is a join or leave announcement.
+func isPresence(msg Message) bool {
+	return msg.Type == typeJoin || msg.Type == typeLeave
+}
+
+// receive returns the next message on ch that isn't a presence
+// announcement. ok is false if ch is closed or nothing arrives in time.
+func receive(ch chan Message, timeout time.Duration) (msg Message, ok bool) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case msg, ok = <-ch:
+			if ok && isPresence(msg) {
+				continue
+			}
+			return msg, ok
+		case <-deadline:
+			return Message{}, false
+		}
+	}
+}
+
+// readChat reads the next message from ws that isn't a presence
+// announcement.
+func readChat(ws *websocket.Conn) (Message, error) {
+	for {
+		var msg Message
+		if err := ws.ReadJSON(&msg); err != nil || !isPresence(msg) {
+			return msg, err
+		}
+	}
+}
+
+// newClient registers a client for user in room that isn't backed by a
+// connection.
+func newClient(hub *Hub, user, room string) *Client {
+	client := &Client{
+		hub:  hub,
+		conn: nil,
+		send: make(chan Message, 256),
+		user: user,
+		room: room,
+	}
+	hub.register <- client
+	return client
+}
+
+// waitForSubscribers gives the hubs' subscribers time to attach to the
+// Redis channel.
+func waitForSubscribers() {
+	time.Sleep(100 * time.Millisecond)
+}
+
+// expectEvent fails the test unless the next message on ch is a typ event
+// for user.
+func expectEvent(t *testing.T, ch chan Message, typ, user string) {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		if msg.Type != typ || msg.UserID != user {
+			t.Errorf("Expected %s for %s, got %+v", typ, user, msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected %s for %s", typ, user)
+	}
+}
+
+// expectNothing fails the test if a message arrives on ch.
+func expectNothing(t *testing.T, ch chan Message) {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		t.Errorf("Expected no event, got %+v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
 }
 
 func TestWebSocketConnection(t *testing.T) {
@@ -73,8 +159,8 @@ func TestWebSocketConnection(t *testing.T) {
 	}
 
 	// Receive the broadcasted message
-	var received Message
-	if err := ws.ReadJSON(&received); err != nil {
+	received, err := readChat(ws)
+	if err != nil {
 		t.Fatalf("Failed to read message: %v", err)
 	}
 
@@ -93,30 +179,788 @@ func TestBroadcasting(t *testing.T) {
 	}
 
 	// Simulate two clients
-	client1 := &Client{
-		hub:  hub,
-		conn: nil,
-		send: make(chan Message, 256),
-		user: "user1",
-	}
-	client2 := &Client{
-		hub:  hub,
-		conn: nil,
-		send: make(chan Message, 256),
-		user: "user2",
-	}
-
-	hub.register <- client1
-	hub.register <- client2
+	client1 := newClient(hub, "user1", "")
+	client2 := newClient(hub, "user2", "")
 
 	// Broadcast message
 	hub.broadcast <- msg
 
 	// Both clients should receive it
-	received1 := <-client1.send
-	received2 := <-client2.send
+	received1, _ := receive(client1.send, time.Second)
+	received2, _ := receive(client2.send, time.Second)
 
 	if received1.Text != "Broadcast test" || received2.Text != "Broadcast test" {
 		t.Errorf("Broadcast failed for one or more clients")
 	}
 }
+
+func TestCrossInstanceBroadcast(t *testing.T) {
+	hubA := setupTestHub(t)
+	hubB := setupTestHub(t)
+	go hubA.run()
+	go hubB.run()
+
+	waitForSubscribers()
+
+	clientA := newClient(hubA, "userA", "")
+	clientB := newClient(hubB, "userB", "")
+
+	hubA.broadcast <- Message{UserID: "userA", Text: "Cross instance"}
+
+	for _, client := range []*Client{clientA, clientB} {
+		received, ok := receive(client.send, time.Second)
+		if !ok {
+			t.Fatalf("Client %s did not receive the message", client.user)
+		}
+		if received.Text != "Cross instance" {
+			t.Errorf("Expected 'Cross instance', got '%s'", received.Text)
+		}
+
+		// The message must be delivered exactly once
+		if dup, ok := receive(client.send, 200*time.Millisecond); ok {
+			t.Errorf("Client %s received duplicate message: %+v", client.user, dup)
+		}
+	}
+}
+
+func TestRoomIsolation(t *testing.T) {
+	hub := setupTestHub(t)
+	go hub.run()
+
+	lobby := newClient(hub, "user1", "lobby")
+	other := newClient(hub, "user2", "other")
+
+	hub.broadcast <- Message{UserID: "user1", Room: "lobby", Text: "Lobby only"}
+
+	received, ok := receive(lobby.send, time.Second)
+	if !ok {
+		t.Fatal("Lobby client did not receive the message")
+	}
+	if received.Room != "lobby" || received.Text != "Lobby only" {
+		t.Errorf("Unexpected message in lobby: %+v", received)
+	}
+
+	if received, ok := receive(other.send, 200*time.Millisecond); ok {
+		t.Errorf("Client in another room received message: %+v", received)
+	}
+}
+
+func TestEmptyRoomCleanup(t *testing.T) {
+	hub := setupTestHub(t)
+	go hub.run()
+
+	client := newClient(hub, "user1", "ephemeral")
+	hub.unregister <- client
+
+	// The send channel is closed once the unregister has been processed
+	if _, ok := receive(client.send, time.Second); ok {
+		t.Fatal("Expected send channel to be closed")
+	}
+
+	hub.mutex.RLock()
+	_, exists := hub.rooms["ephemeral"]
+	hub.mutex.RUnlock()
+	if exists {
+		t.Error("Expected empty room to be removed")
+	}
+}
+
+func TestUnregisterAfterSlowClientRemoval(t *testing.T) {
+	hub := setupTestHub(t)
+	go hub.run()
+
+	// A full send buffer forces the hub to drop the client
+	slow := &Client{
+		hub:  hub,
+		conn: nil,
+		send: make(chan Message, 1),
+		user: "slow",
+	}
+	slow.send <- Message{UserID: "user1", Text: "Backlog"}
+	hub.register <- slow
+	hub.broadcast <- Message{UserID: "user1", Text: "Too fast"}
+
+	// The hub handles one event at a time, so once this register is accepted
+	// the broadcast above has been fully processed
+	probe := newClient(hub, "probe", "")
+
+	<-slow.send
+	if _, ok := <-slow.send; ok {
+		t.Fatal("Expected slow client's send channel to be closed")
+	}
+
+	// readPump still unregisters the client; this must not close send again
+	hub.unregister <- slow
+
+	hub.broadcast <- Message{UserID: "probe", Text: "Still alive"}
+	if _, ok := receive(probe.send, time.Second); !ok {
+		t.Fatal("Hub stopped processing after duplicate unregister")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	hub := setupTestHub(t)
+	go hub.run()
+
+	room := "history-test"
+	hub.redis.Del(context.Background(), historyKey(room))
+
+	for _, text := range []string{"first", "second", "third"} {
+		hub.broadcast <- Message{UserID: "user1", Room: room, Text: text}
+	}
+
+	// Round-trip through the hub so the last broadcast has been persisted
+	newClient(hub, "probe", "probe")
+
+	server := httptest.NewServer(newRouter(hub))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/history?room=" + room + "&limit=2")
+	if err != nil {
+		t.Fatalf("Failed to get history: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var messages []Message
+	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+		t.Fatalf("Failed to decode history: %v", err)
+	}
+	if len(messages) != 2 || messages[0].Text != "second" || messages[1].Text != "third" {
+		t.Errorf("Expected [second third], got %+v", messages)
+	}
+
+	resp, err = http.Get(server.URL + "/history?room=" + room + "&limit=abc")
+	if err != nil {
+		t.Fatalf("Failed to get history: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid limit, got %d", resp.StatusCode)
+	}
+}
+
+func signToken(t *testing.T, claims jwt.MapClaims, secret []byte) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return token
+}
+
+// dialAs opens a WebSocket to room on serverURL, authenticated as user.
+func dialAs(t *testing.T, serverURL, user, room string) *websocket.Conn {
+	t.Helper()
+	token := signToken(t, jwt.MapClaims{"sub": user, "exp": time.Now().Add(time.Hour).Unix()}, jwtSecret)
+	wsURL := "ws" + strings.TrimPrefix(serverURL, "http") + "/ws?room=" + room + "&token=" + token
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	return ws
+}
+
+func TestAuthenticate(t *testing.T) {
+	jwtSecret = []byte("test-secret")
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := signToken(t, jwt.MapClaims{"sub": "alice", "exp": exp}, jwtSecret)
+
+	tests := []struct {
+		name    string
+		header  string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{name: "bearer header", header: "Bearer " + valid, want: "alice"},
+		{name: "token query param", query: "token=" + valid, want: "alice"},
+		{name: "missing token", wantErr: true},
+		{name: "expired token", header: "Bearer " + signToken(t, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()}, jwtSecret), wantErr: true},
+		{name: "no expiry", header: "Bearer " + signToken(t, jwt.MapClaims{"sub": "alice"}, jwtSecret), wantErr: true},
+		{name: "wrong secret", header: "Bearer " + signToken(t, jwt.MapClaims{"sub": "alice", "exp": exp}, []byte("other-secret")), wantErr: true},
+		{name: "missing sub", header: "Bearer " + signToken(t, jwt.MapClaims{"exp": exp}, jwtSecret), wantErr: true},
+		{name: "malformed token", header: "Bearer not-a-jwt", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws?"+tt.query, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+
+			user, err := authenticate(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error, got user '%s'", user)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if user != tt.want {
+				t.Errorf("Expected user '%s', got '%s'", tt.want, user)
+			}
+		})
+	}
+}
+
+func TestWebSocketRequiresAuth(t *testing.T) {
+	hub := setupTestHub(t)
+	go hub.run()
+
+	jwtSecret = []byte("test-secret")
+	server := httptest.NewServer(newRouter(hub))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"?user=mallory", nil)
+	if err == nil {
+		t.Fatal("Expected dial without a token to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, got %v", resp)
+	}
+
+	token := signToken(t, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}, jwtSecret)
+	header := http.Header{"Authorization": []string{"Bearer " + token}}
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL+"?room=auth-test", header)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer ws.Close()
+
+	if err := ws.WriteJSON(Message{UserID: "mallory", Text: "Hi"}); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+
+	received, err := readChat(ws)
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if received.UserID != "alice" {
+		t.Errorf("Expected user_id from token 'alice', got '%s'", received.UserID)
+	}
+}
+
+func TestDirectMessage(t *testing.T) {
+	hubA := setupTestHub(t)
+	hubB := setupTestHub(t)
+	go hubA.run()
+	go hubB.run()
+
+	waitForSubscribers()
+
+	// alice has one tab on each instance, in different rooms
+	aliceA := newClient(hubA, "alice", "dm-room-1")
+	aliceB := newClient(hubB, "alice", "dm-room-2")
+	bob := newClient(hubA, "bob", "dm-room-1")
+	carol := newClient(hubB, "carol", "dm-room-2")
+
+	hubA.broadcast <- Message{UserID: "bob", Room: "dm-room-1", To: "alice", Text: "Psst"}
+
+	for _, client := range []*Client{aliceA, aliceB, bob} {
+		received, ok := receive(client.send, time.Second)
+		if !ok {
+			t.Fatalf("Client %s did not receive the direct message", client.user)
+		}
+		if received.Text != "Psst" || received.To != "alice" {
+			t.Errorf("Unexpected message for %s: %+v", client.user, received)
+		}
+	}
+
+	if received, ok := receive(carol.send, 200*time.Millisecond); ok {
+		t.Errorf("Direct message leaked to carol: %+v", received)
+	}
+	for _, client := range []*Client{aliceA, aliceB, bob} {
+		if dup, ok := receive(client.send, 50*time.Millisecond); ok {
+			t.Errorf("Client %s received duplicate message: %+v", client.user, dup)
+		}
+	}
+
+	// A recipient that isn't connected anywhere only gets the sender's echo
+	hubA.broadcast <- Message{UserID: "bob", Room: "dm-room-1", To: "nobody", Text: "Hello?"}
+	received, ok := receive(bob.send, time.Second)
+	if !ok {
+		t.Fatal("Sender did not receive the echo")
+	}
+	if received.Text != "Hello?" {
+		t.Errorf("Expected echo 'Hello?', got '%s'", received.Text)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(0.001, 2)
+
+	if !limiter.allow("alice") || !limiter.allow("alice") {
+		t.Fatal("Expected burst of 2 messages to be allowed")
+	}
+	if limiter.allow("alice") {
+		t.Error("Expected third message to be throttled")
+	}
+	if !limiter.allow("bob") {
+		t.Error("Expected other users to have their own bucket")
+	}
+
+	// Only buckets that have refilled are swept
+	limiter.sweep()
+	if _, ok := limiter.buckets["alice"]; !ok {
+		t.Error("Expected sweep to keep a drained bucket")
+	}
+	if limiter.allow("alice") {
+		t.Error("Expected alice to still be throttled after sweep")
+	}
+
+	fast := newRateLimiter(1000, 2)
+	fast.allow("alice")
+	time.Sleep(10 * time.Millisecond)
+	fast.sweep()
+	if _, ok := fast.buckets["alice"]; ok {
+		t.Error("Expected sweep to drop a refilled bucket")
+	}
+}
+
+func TestRateLimitThrottlesClient(t *testing.T) {
+	hub := setupTestHub(t)
+	hub.limiter = newRateLimiter(0.001, 2)
+	go hub.run()
+
+	jwtSecret = []byte("test-secret")
+	server := httptest.NewServer(newRouter(hub))
+	defer server.Close()
+
+	ws := dialAs(t, server.URL, "flooder", "rate-test")
+
+	for i := 0; i < 4; i++ {
+		if err := ws.WriteJSON(Message{Text: "spam"}); err != nil {
+			t.Fatalf("Failed to write message: %v", err)
+		}
+	}
+
+	// Two messages fit in the burst, then a single throttle notice
+	for i, want := range []string{"", "", typeSystem} {
+		received, err := readChat(ws)
+		if err != nil {
+			t.Fatalf("Failed to read message %d: %v", i, err)
+		}
+		if received.Type != want {
+			t.Errorf("Message %d: expected type '%s', got %+v", i, want, received)
+		}
+	}
+
+	// The client stays connected while throttled
+	ws.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	var extra Message
+	if err := ws.ReadJSON(&extra); err == nil {
+		t.Errorf("Expected no further messages, got %+v", extra)
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Throttled client was disconnected: %v", err)
+	}
+	ws.Close()
+
+	// Wait for the hub to unregister the connection
+	deadline := time.Now().Add(time.Second)
+	for {
+		hub.mutex.RLock()
+		_, ok := hub.rooms["rate-test"]
+		hub.mutex.RUnlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected client to be unregistered after disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Reconnecting doesn't refill the burst
+	ws = dialAs(t, server.URL, "flooder", "rate-test")
+	defer ws.Close()
+
+	if err := ws.WriteJSON(Message{Text: "spam"}); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	received, err := readChat(ws)
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if received.Type != typeSystem {
+		t.Errorf("Expected throttle notice after reconnect, got %+v", received)
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	hub := setupTestHub(t)
+	go hub.run()
+
+	jwtSecret = []byte("test-secret")
+	server := httptest.NewServer(newRouter(hub))
+	defer server.Close()
+
+	ws := dialAs(t, server.URL, "alice", "close-test")
+	defer ws.Close()
+
+	// Make sure the client is registered before closing the hub
+	if err := ws.WriteJSON(Message{Text: "Before close"}); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	if _, err := readChat(ws); err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+
+	if err := hub.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected close frame with code %d, got %v", websocket.CloseGoingAway, err)
+	}
+
+	// Closing twice is a no-op
+	if err := hub.Close(); err != nil {
+		t.Errorf("Second Close failed: %v", err)
+	}
+}
+
+func TestMessageValidate(t *testing.T) {
+	defer func(old int) { maxTextLength = old }(maxTextLength)
+	maxTextLength = 10
+
+	tests := []struct {
+		name string
+		text string
+		want error
+	}{
+		{name: "valid", text: "hello", want: nil},
+		{name: "empty", text: "", want: errEmptyText},
+		{name: "whitespace only", text: "  \n\t", want: errEmptyText},
+		{name: "at limit", text: "éééééééééé", want: nil},
+		{name: "too long", text: "hello world", want: errTextTooLong},
+		{name: "invalid utf8", text: "bad \xff", want: errInvalidUTF8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (Message{Text: tt.text}).validate(); err != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestInvalidMessagesAreSkipped(t *testing.T) {
+	hub := setupTestHub(t)
+	go hub.run()
+
+	defer func(old int) { maxTextLength = old }(maxTextLength)
+	maxTextLength = 10
+	jwtSecret = []byte("test-secret")
+	server := httptest.NewServer(newRouter(hub))
+	defer server.Close()
+
+	ws := dialAs(t, server.URL, "alice", "validate-test")
+	defer ws.Close()
+
+	invalid := [][]byte{
+		[]byte(`{"text": ""}`),
+		[]byte(`{"text": "this is far too long"}`),
+		[]byte("{\"text\": \"bad \xff\"}"),
+		[]byte(`not json`),
+	}
+	for _, data := range invalid {
+		if err := ws.WriteMessage(websocket.TextMessage, data); err != nil {
+			t.Fatalf("Failed to write message: %v", err)
+		}
+	}
+	if err := ws.WriteJSON(Message{Text: "ok"}); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+
+	// Only the valid message comes back, and the connection stays open
+	received, err := readChat(ws)
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if received.Text != "ok" {
+		t.Errorf("Expected 'ok', got '%s'", received.Text)
+	}
+	if received.Timestamp == 0 {
+		t.Error("Expected server to stamp the timestamp")
+	}
+}
+
+func getPresence(t *testing.T, serverURL, room string) []string {
+	resp, err := http.Get(serverURL + "/presence?room=" + room)
+	if err != nil {
+		t.Fatalf("Failed to get presence: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var users []string
+	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+		t.Fatalf("Failed to decode presence: %v", err)
+	}
+	return users
+}
+
+func TestPresenceEvents(t *testing.T) {
+	hub := setupTestHub(t)
+	go hub.run()
+
+	room := "presence-test"
+	hub.redis.Del(context.Background(), presenceKey(room))
+
+	server := httptest.NewServer(newRouter(hub))
+	defer server.Close()
+
+	observer := newClient(hub, "observer", room)
+	expectEvent(t, observer.send, typeJoin, "observer")
+
+	// alice opens two tabs; only the first announces a join
+	tab1 := newClient(hub, "alice", room)
+	expectEvent(t, observer.send, typeJoin, "alice")
+	tab2 := newClient(hub, "alice", room)
+	expectNothing(t, observer.send)
+
+	if users := getPresence(t, server.URL, room); strings.Join(users, ",") != "alice,observer" {
+		t.Errorf("Expected [alice observer], got %v", users)
+	}
+
+	// Closing one tab doesn't make alice leave
+	hub.unregister <- tab1
+	expectNothing(t, observer.send)
+
+	hub.unregister <- tab2
+	expectEvent(t, observer.send, typeLeave, "alice")
+
+	if users := getPresence(t, server.URL, room); strings.Join(users, ",") != "observer" {
+		t.Errorf("Expected [observer], got %v", users)
+	}
+}
+
+func TestPresenceRemovedOnDisconnect(t *testing.T) {
+	hub := setupTestHub(t)
+	go hub.run()
+
+	room := "presence-drop-test"
+	hub.redis.Del(context.Background(), presenceKey(room))
+
+	jwtSecret = []byte("test-secret")
+	server := httptest.NewServer(newRouter(hub))
+	defer server.Close()
+
+	ws := dialAs(t, server.URL, "alice", room)
+
+	var joined Message
+	if err := ws.ReadJSON(&joined); err != nil || joined.Type != typeJoin {
+		t.Fatalf("Expected join event, got %+v (%v)", joined, err)
+	}
+
+	// Drop the TCP connection without a close handshake
+	ws.UnderlyingConn().Close()
+
+	deadline := time.Now().Add(time.Second)
+	for len(getPresence(t, server.URL, room)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected presence entry to be removed after disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAccessLogRedactsToken(t *testing.T) {
+	var logs bytes.Buffer
+	defer func(w io.Writer) { gin.DefaultWriter = w }(gin.DefaultWriter)
+	gin.DefaultWriter = &logs
+
+	// The handshake is rejected before the hub is used, so Redis isn't needed
+	jwtSecret = []byte("test-secret")
+	hub := NewHub(redis.NewClient(&redis.Options{Addr: "redis:6379"}))
+	server := httptest.NewServer(newRouter(hub))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/ws?room=log-test&token=secret-token-value")
+	if err != nil {
+		t.Fatalf("Failed to call /ws: %v", err)
+	}
+	resp.Body.Close()
+
+	if strings.Contains(logs.String(), "secret-token-value") {
+		t.Errorf("Token leaked into access log: %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "/ws?room=log-test&token=REDACTED") {
+		t.Errorf("Expected redacted request in access log, got: %s", logs.String())
+	}
+}
+
+func TestServeAfterClose(t *testing.T) {
+	hub := setupTestHub(t)
+	go hub.run()
+	if err := hub.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// A handshake that completed just before shutdown is turned away
+	served := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Failed to upgrade: %v", err)
+			return
+		}
+		hub.serve(conn, "late", "close-race-test")
+		close(served)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	defer ws.Close()
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("serve blocked after Close")
+	}
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Error("Expected connection to be closed")
+	}
+}
+
+func TestMaxLengthMessageFitsFrame(t *testing.T) {
+	hub := setupTestHub(t)
+	go hub.run()
+
+	defer func(old int) { maxTextLength = old }(maxTextLength)
+	maxTextLength = 3000
+	jwtSecret = []byte("test-secret")
+	server := httptest.NewServer(newRouter(hub))
+	defer server.Close()
+
+	ws := dialAs(t, server.URL, "alice", "frame-test")
+	defer ws.Close()
+
+	// The longest valid text, with every character escaped as a surrogate pair
+	data := `{"text": "` + strings.Repeat(`\ud83d\ude00`, maxTextLength) + `"}`
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(data)); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+
+	received, err := readChat(ws)
+	if err != nil {
+		t.Fatalf("Connection closed on a valid message: %v", err)
+	}
+	if n := utf8.RuneCountInString(received.Text); n != maxTextLength {
+		t.Errorf("Expected %d characters, got %d", maxTextLength, n)
+	}
+}
+
+func TestPresenceCrashedInstance(t *testing.T) {
+	hubA := setupTestHub(t)
+	hubB := setupTestHub(t)
+	go hubA.run()
+	go hubB.run()
+
+	room := "presence-crash-test"
+	ctx := context.Background()
+	hubB.redis.Del(ctx, presenceKey(room))
+
+	waitForSubscribers()
+
+	server := httptest.NewServer(newRouter(hubB))
+	defer server.Close()
+
+	observer := newClient(hubB, "observer", room)
+	expectEvent(t, observer.send, typeJoin, "observer")
+
+	newClient(hubA, "alice", room)
+	expectEvent(t, observer.send, typeJoin, "alice")
+
+	if ttl := hubB.redis.TTL(ctx, instancePresenceKey(room, hubA.id)).Val(); ttl <= 0 || ttl > presenceTTL {
+		t.Errorf("Expected presence entry to expire within %v, got TTL %v", presenceTTL, ttl)
+	}
+
+	// Simulate instance A crashing and its entry expiring
+	hubA.cancel()
+	hubB.redis.Del(ctx, instancePresenceKey(room, hubA.id))
+
+	if users := getPresence(t, server.URL, room); strings.Join(users, ",") != "observer" {
+		t.Errorf("Expected [observer] after crash, got %v", users)
+	}
+
+	alice := newClient(hubB, "alice", room)
+	expectEvent(t, observer.send, typeJoin, "alice")
+	hubB.unregister <- alice
+	expectEvent(t, observer.send, typeLeave, "alice")
+
+	if users := getPresence(t, server.URL, room); strings.Join(users, ",") != "observer" {
+		t.Errorf("Expected [observer], got %v", users)
+	}
+}
+
+func TestRefreshPresence(t *testing.T) {
+	hub := setupTestHub(t)
+	go hub.run()
+
+	room := "presence-refresh-test"
+	ctx := context.Background()
+	key := instancePresenceKey(room, hub.id)
+	hub.redis.Del(ctx, presenceKey(room), key)
+
+	alice := newClient(hub, "alice", room)
+	expectEvent(t, alice.send, typeJoin, "alice")
+
+	// Corrupt the entry and let it get close to expiring
+	hub.redis.HSet(ctx, key, "ghost", 1)
+	hub.redis.Expire(ctx, key, time.Second)
+	hub.redis.Expire(ctx, presenceKey(room), time.Second)
+
+	hub.refreshPresence()
+
+	entry := hub.redis.HGetAll(ctx, key).Val()
+	if len(entry) != 1 || entry["alice"] != "1" {
+		t.Errorf("Expected entry {alice: 1}, got %v", entry)
+	}
+	for _, k := range []string{key, presenceKey(room)} {
+		if ttl := hub.redis.TTL(ctx, k).Val(); ttl <= time.Second || ttl > presenceTTL {
+			t.Errorf("Expected TTL of %s to be reset to %v, got %v", k, presenceTTL, ttl)
+		}
+	}
+}
+
+func TestHubCloseAnnouncesLeaves(t *testing.T) {
+	hubA := setupTestHub(t)
+	hubB := setupTestHub(t)
+	go hubA.run()
+	go hubB.run()
+
+	room := "close-leave-test"
+	hubB.redis.Del(context.Background(), presenceKey(room))
+
+	waitForSubscribers()
+
+	observer := newClient(hubB, "observer", room)
+	expectEvent(t, observer.send, typeJoin, "observer")
+	newClient(hubA, "alice", room)
+	expectEvent(t, observer.send, typeJoin, "alice")
+
+	if err := hubA.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	expectEvent(t, observer.send, typeLeave, "alice")
+	if users := hubB.online(room); strings.Join(users, ",") != "observer" {
+		t.Errorf("Expected [observer] after Close, got %v", users)
+	}
+}